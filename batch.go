@@ -0,0 +1,182 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// BatchReplay is implemented by anything that wants to receive the key/value
+// pairs accumulated in a FlatBatch, via FlatBatch.Replay.
+type BatchReplay interface {
+	Put(key, value []byte) error
+}
+
+// batchIndex records where one key/value pair lives inside FlatBatch.data,
+// letting Replay address any entry in O(1) without re-parsing the varint
+// framing; Len and Write use only the number of entries.
+type batchIndex struct {
+	keyPos, keyLen     int
+	valuePos, valueLen int
+}
+
+// FlatBatch is a write-only staging area for a FlatDatabase: entries are
+// marshalled once, in the same "Key Length | Key | Value Length | Value"
+// format as the database itself, into a single contiguous buffer. Write then
+// appends that buffer to the host db in one shot, taking db.lock only once
+// regardless of how many entries the batch holds.
+type FlatBatch struct {
+	db    *FlatDatabase
+	data  []byte
+	index []batchIndex
+	lock  sync.RWMutex
+}
+
+// Put inserts the given value into the key-value data store.
+func (fb *FlatBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 || len(value) == 0 {
+		return ErrEmptyEntry
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	var lenBuf [binary.MaxVarintLen64]byte
+
+	n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+	fb.data = append(fb.data, lenBuf[:n]...)
+	keyPos := len(fb.data)
+	fb.data = append(fb.data, key...)
+
+	n = binary.PutUvarint(lenBuf[:], uint64(len(value)))
+	fb.data = append(fb.data, lenBuf[:n]...)
+	valuePos := len(fb.data)
+	fb.data = append(fb.data, value...)
+
+	fb.index = append(fb.index, batchIndex{keyPos, len(key), valuePos, len(value)})
+	return nil
+}
+
+// Delete removes the key from the key-value data store.
+func (fb *FlatBatch) Delete(key []byte) error { panic("not supported") }
+
+// Len returns the number of key/value pairs queued in the batch.
+func (fb *FlatBatch) Len() int {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+
+	return len(fb.index)
+}
+
+// ValueSize retrieves the amount of data queued up for writing, including
+// the varint framing overhead of each entry.
+func (fb *FlatBatch) ValueSize() int {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+
+	return len(fb.data)
+}
+
+// Replay replays the batch contents in the order they were queued.
+func (fb *FlatBatch) Replay(r BatchReplay) error {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+
+	for _, idx := range fb.index {
+		key := fb.data[idx.keyPos : idx.keyPos+idx.keyLen]
+		value := fb.data[idx.valuePos : idx.valuePos+idx.valueLen]
+		if err := r.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dump returns a copy of the batch's serialized contents, suitable for
+// shipping over the wire or to disk and later restored with Load.
+func (fb *FlatBatch) Dump() []byte {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+
+	data := make([]byte, len(fb.data))
+	copy(data, fb.data)
+	return data
+}
+
+// Load replaces the batch's contents with a buffer previously produced by
+// Dump, rebuilding the random-access index by re-parsing its framing.
+func (fb *FlatBatch) Load(data []byte) error {
+	var (
+		index  []batchIndex
+		offset int
+	)
+	for offset < len(data) {
+		klen, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return ErrReadFailure
+		}
+		offset += n
+		keyPos := offset
+		offset += int(klen)
+		if offset > len(data) {
+			return ErrReadFailure
+		}
+		vlen, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return ErrReadFailure
+		}
+		offset += n
+		valuePos := offset
+		offset += int(vlen)
+		if offset > len(data) {
+			return ErrReadFailure
+		}
+		index = append(index, batchIndex{keyPos, int(klen), valuePos, int(vlen)})
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.data = append(fb.data[:0], data...)
+	fb.index = index
+	return nil
+}
+
+// Write appends the whole batch to the host db in a single copy, taking
+// db.lock only once no matter how many entries are queued.
+func (fb *FlatBatch) Write() error {
+	fb.lock.RLock()
+	defer fb.lock.RUnlock()
+
+	if len(fb.index) == 0 {
+		return nil
+	}
+	db := fb.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.read {
+		return ErrReadOnly
+	}
+	db.grow(len(fb.data))
+	offset := len(db.buff)
+	db.buff = db.buff[:offset+len(fb.data)]
+	copy(db.buff[offset:], fb.data)
+	db.items += len(fb.index)
+
+	// db.offset is monotonic increasing in "WRITE" mode, see Put.
+	db.offset += uint64(len(fb.data))
+	return db.writeChunk(false)
+}
+
+// Reset resets the batch for reuse.
+func (fb *FlatBatch) Reset() {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.data = fb.data[:0]
+	fb.index = fb.index[:0]
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const convertTempDir = "convert-tmp"
+
+// Convert reads the already-committed flat database at path and rewrites it
+// in the given target file format. flat.db and flat.index are each replaced
+// by an atomic rename, one after the other; the pair is not swapped as a unit.
+//
+// It works by replaying the source db through a fresh write-mode db opened
+// in a scratch subdirectory, Commit-ing that (which itself writes via a
+// temporary file and renames into place), and then moving the freshly
+// written flat.db/flat.index over the originals with the same rename/syncDir
+// primitives used elsewhere in this package.
+func Convert(path string, target Version) error {
+	src, err := NewFlatDatabase(path, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if src.version == target {
+		return nil
+	}
+
+	tmpDir := filepath.Join(path, convertTempDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dst, err := NewFlatDatabaseWithOptions(tmpDir, false, &Options{FileFormat: target})
+	if err != nil {
+		return err
+	}
+	iter := src.NewIterator(nil, nil)
+	for iter.Next() {
+		if err := dst.Put(iter.Key(), iter.Value()); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iterErr := iter.Error()
+	iter.Release()
+	if iterErr != nil {
+		return iterErr
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	if err := rename(filepath.Join(tmpDir, syncedName), filepath.Join(path, syncedName)); err != nil {
+		return err
+	}
+	if err := rename(filepath.Join(tmpDir, indexName), filepath.Join(path, indexName)); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
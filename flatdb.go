@@ -7,12 +7,17 @@
 package flatdb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+
+	"github.com/golang/snappy"
 )
 
 const (
@@ -21,6 +26,17 @@ const (
 	indexName     = "flat.index"
 	bufferGrowRec = 3000
 	chunkSize     = 4 * 1024 * 1024
+
+	chunkHeaderSize  = 4 // 4-byte big-endian payload length
+	chunkTrailerSize = 4 // 4-byte big-endian CRC32C of the payload
+	chunkFrameSize   = chunkHeaderSize + chunkTrailerSize
+
+	// indexEntrySize is {logical offset uint64, physical offset uint64, flags uint8}.
+	// The flags byte records the compression codec used for that particular
+	// chunk, and readChunk decodes each chunk by its own flag. A write-mode
+	// handle truncates both files and applies one codec to every chunk it
+	// writes, so files produced here carry a single codec.
+	indexEntrySize = 17
 )
 
 var (
@@ -31,6 +47,23 @@ var (
 	ErrEmptyEntry   = errors.New("empty entry")
 )
 
+// crc32cTable is the Castagnoli polynomial table used to checksum chunks,
+// the same polynomial leveldb/rocksdb use for their block checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted is returned by readChunk (and surfaced through FlatIterator.Error)
+// when a chunk's on-disk CRC32C doesn't match its payload, in the style of
+// goleveldb's ErrBatchCorrupted.
+type ErrCorrupted struct {
+	Reason     string
+	ChunkIndex int
+	Offset     uint64
+}
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("flatdb: corrupted chunk #%d at offset %d: %s", e.ChunkIndex, e.Offset, e.Reason)
+}
+
 // FlatDatabase is the "database" based on the raw file. It can be used in
 // some special scenarios where the **random read is not required** and all
 // writes are append only. In this case the flatDatabase can offer you the
@@ -55,17 +88,41 @@ type FlatDatabase struct {
 	buff      []byte   // Auxiliary buffer for storing uncommitted data
 	items     int      // Auxiliary number for counting uncommitted data
 	iterating bool     // Indicator whether the db is iterating. Concurrent iteration is not supported
-	offset    uint64   // Global offset of entry in the file
+	offset    uint64   // Global logical offset of entry in the file
+	physOff   uint64   // Global physical (on-disk, post-framing) offset of entry in the file
+	chunk     int      // Index of the next chunk to be read, used for ErrCorrupted reporting
+
+	version     Version         // File format of the chunks written/read by this db handle
+	compression CompressionType // Codec applied to chunks written by this db handle
+
+	buildSortedIndex bool // Whether Commit should persist flat.sindex for this write session
+
+	// indexEnd, if non-zero, caps readChunk to the index entries that existed
+	// when a FlatSnapshot was taken, even if the underlying files have grown
+	// since. See Snapshot.
+	indexEnd int64
 }
 
+// NewFlatDatabase creates a flat database with the default options, i.e.
+// without chunk compression.
 func NewFlatDatabase(path string, read bool) (*FlatDatabase, error) {
+	return NewFlatDatabaseWithOptions(path, read, nil)
+}
+
+// NewFlatDatabaseWithOptions creates a flat database with the given options.
+// A nil opts is equivalent to &Options{Compression: CompressionNone}.
+func NewFlatDatabaseWithOptions(path string, read bool, opts *Options) (*FlatDatabase, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
 	var (
-		data  *os.File
-		index *os.File
-		err   error
+		data    *os.File
+		index   *os.File
+		version Version
+		err     error
 	)
 	if read {
 		data, err = os.OpenFile(filepath.Join(path, syncedName), os.O_RDONLY, 0644)
@@ -76,7 +133,29 @@ func NewFlatDatabase(path string, read bool) (*FlatDatabase, error) {
 		if err != nil {
 			return nil, err
 		}
+		dataHeader, err := readFlatHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		indexHeader, err := readFlatHeader(index)
+		if err != nil {
+			return nil, err
+		}
+		if dataHeader.version != indexHeader.version {
+			return nil, fmt.Errorf("flatdb: flat.db is format V%d but flat.index is format V%d", dataHeader.version, indexHeader.version)
+		}
+		version = indexHeader.version
+		if version != V1 && version != V2 {
+			return nil, unsupportedVersionError(version)
+		}
 	} else {
+		version = opts.format()
+		if version != V1 && version != V2 {
+			return nil, unsupportedVersionError(version)
+		}
+		if version == V1 && opts.Compression != CompressionNone {
+			return nil, errors.New("flatdb: chunk compression requires file format V2")
+		}
 		data, err = os.OpenFile(filepath.Join(path, temporaryName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			return nil, err
@@ -85,12 +164,23 @@ func NewFlatDatabase(path string, read bool) (*FlatDatabase, error) {
 		if err != nil {
 			return nil, err
 		}
+		if version == V2 {
+			if err := writeFlatHeader(data, flatHeader{version: V2}); err != nil {
+				return nil, err
+			}
+			if err := writeFlatHeader(index, flatHeader{version: V2}); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return &FlatDatabase{
-		path:  path,
-		data:  data,
-		index: index,
-		read:  read,
+		path:             path,
+		data:             data,
+		index:            index,
+		read:             read,
+		version:          version,
+		compression:      opts.Compression,
+		buildSortedIndex: !read && opts.BuildSortedIndex,
 	}, nil
 }
 
@@ -145,11 +235,22 @@ func (db *FlatDatabase) grow(n int) {
 	}
 }
 
+// writeChunk flushes the buffered entries as a single chunk, dispatching to
+// the implementation of the file format this db handle was opened with.
 func (db *FlatDatabase) writeChunk(force bool) error {
+	if db.version == V1 {
+		return db.writeChunkV1(force)
+	}
+	return db.writeChunkV2(force)
+}
+
+// writeChunkV1 is the original headerless framing: the raw payload is
+// appended to flat.db as-is and its cumulative logical offset is appended
+// to flat.index as a single 8-byte big-endian integer.
+func (db *FlatDatabase) writeChunkV1(force bool) error {
 	if len(db.buff) < chunkSize && !force {
 		return nil
 	}
-	// Step one, flush data
 	n, err := db.data.Write(db.buff)
 	if err != nil {
 		return err
@@ -160,7 +261,6 @@ func (db *FlatDatabase) writeChunk(force bool) error {
 	db.buff = db.buff[:0]
 	db.items = 0
 
-	// Step two, flush chunk offset
 	var local [8]byte
 	binary.BigEndian.PutUint64(local[:], db.offset)
 	n, err = db.index.Write(local[:])
@@ -173,8 +273,86 @@ func (db *FlatDatabase) writeChunk(force bool) error {
 	return nil
 }
 
+// writeChunkV2 flushes the buffered entries as a single framed chunk:
+//
+//   +-----------------+---------+--------------+
+//   | Payload Length  | Payload | CRC32C(Payload) |
+//   +-----------------+---------+--------------+
+//
+// Payload is the (possibly compressed) on-disk representation of db.buff; the
+// codec used is recorded in the chunk's flat.index entry rather than in the
+// frame itself. Both the logical (pre-compression) and physical (post-framing)
+// offset of the chunk boundary are recorded in flat.index so a corrupted
+// chunk can later be identified and skipped by Recover without losing track
+// of either offset space.
+func (db *FlatDatabase) writeChunkV2(force bool) error {
+	if len(db.buff) < chunkSize && !force {
+		return nil
+	}
+	payload, flag := db.buff, CompressionNone
+	if db.compression == CompressionSnappy {
+		payload = snappy.Encode(nil, db.buff)
+		flag = CompressionSnappy
+	}
+	// Step one, flush the framed chunk: length header, payload, CRC32C trailer.
+	var header [chunkHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := db.data.Write(header[:]); err != nil {
+		return err
+	}
+	n, err := db.data.Write(payload)
+	if err != nil {
+		return err
+	}
+	if n != len(payload) {
+		return ErrWriteFailure
+	}
+	var trailer [chunkTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:], crc32.Checksum(payload, crc32cTable))
+	if _, err := db.data.Write(trailer[:]); err != nil {
+		return err
+	}
+	db.physOff += uint64(chunkFrameSize + len(payload))
+	db.buff = db.buff[:0]
+	db.items = 0
+
+	// Step two, flush the chunk index entry
+	var local [indexEntrySize]byte
+	binary.BigEndian.PutUint64(local[:8], db.offset)
+	binary.BigEndian.PutUint64(local[8:16], db.physOff)
+	local[16] = byte(flag)
+	n, err = db.index.Write(local[:])
+	if err != nil {
+		return err
+	}
+	if n != indexEntrySize {
+		return ErrWriteFailure
+	}
+	return nil
+}
+
+// readChunk reads the next chunk, dispatching to the implementation of the
+// file format this db handle was opened with.
 func (db *FlatDatabase) readChunk() error {
-	// Step one, read chunk size
+	if db.version == V1 {
+		return db.readChunkV1()
+	}
+	return db.readChunkV2()
+}
+
+// readChunkV1 reads a chunk written by writeChunkV1: a raw, unframed payload
+// whose size is derived from the cumulative logical offsets stored in
+// flat.index.
+func (db *FlatDatabase) readChunkV1() error {
+	if db.indexEnd > 0 {
+		pos, err := db.index.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if pos >= db.indexEnd {
+			return io.EOF
+		}
+	}
 	var local [8]byte
 	n, err := db.index.Read(local[:])
 	if err != nil {
@@ -199,6 +377,76 @@ func (db *FlatDatabase) readChunk() error {
 	return nil
 }
 
+func (db *FlatDatabase) readChunkV2() error {
+	if db.indexEnd > 0 {
+		pos, err := db.index.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if pos >= db.indexEnd {
+			return io.EOF
+		}
+	}
+	// Step one, read the chunk index entry
+	var local [indexEntrySize]byte
+	n, err := db.index.Read(local[:])
+	if err != nil {
+		return err // may return EOF
+	}
+	if n != indexEntrySize {
+		return ErrReadFailure
+	}
+	offset := binary.BigEndian.Uint64(local[:8])
+	physOff := binary.BigEndian.Uint64(local[8:16])
+	flag := CompressionType(local[16])
+	size := int(offset - db.offset)
+	frameSize := int(physOff - db.physOff)
+
+	// Step two, read the framed chunk and verify its length header
+	frame := make([]byte, frameSize)
+	n, err = db.data.Read(frame)
+	if err != nil {
+		return err // may return EOF
+	}
+	if n != frameSize {
+		return ErrReadFailure
+	}
+	declared := binary.BigEndian.Uint32(frame[:chunkHeaderSize])
+	payload := frame[chunkHeaderSize : frameSize-chunkTrailerSize]
+	if int(declared) != len(payload) {
+		return &ErrCorrupted{Reason: "payload length mismatch", ChunkIndex: db.chunk, Offset: db.physOff}
+	}
+	trailer := binary.BigEndian.Uint32(frame[frameSize-chunkTrailerSize:])
+	if crc32.Checksum(payload, crc32cTable) != trailer {
+		return &ErrCorrupted{Reason: "crc32c mismatch", ChunkIndex: db.chunk, Offset: db.physOff}
+	}
+
+	var decoded []byte
+	switch flag {
+	case CompressionNone:
+		decoded = payload
+	case CompressionSnappy:
+		decoded, err = snappy.Decode(nil, payload)
+		if err != nil {
+			return &ErrCorrupted{Reason: "snappy: " + err.Error(), ChunkIndex: db.chunk, Offset: db.physOff}
+		}
+	default:
+		return &ErrCorrupted{Reason: "unknown compression codec", ChunkIndex: db.chunk, Offset: db.physOff}
+	}
+	if len(decoded) != size {
+		return &ErrCorrupted{Reason: "decoded length mismatch", ChunkIndex: db.chunk, Offset: db.physOff}
+	}
+
+	db.offset = offset
+	db.physOff = physOff
+	db.chunk++
+
+	db.grow(size)
+	db.buff = db.buff[:size]
+	copy(db.buff, decoded)
+	return nil
+}
+
 // Commit flushs all in-memory data into the disk and switchs the db to read mode.
 func (db *FlatDatabase) Commit() error {
 	db.lock.Lock()
@@ -207,6 +455,11 @@ func (db *FlatDatabase) Commit() error {
 	if err := db.closeNoLock(); err != nil {
 		return err
 	}
+	if db.buildSortedIndex {
+		if err := buildSparseIndex(db.path, db.version); err != nil {
+			return err
+		}
+	}
 	if err := rename(filepath.Join(db.path, temporaryName), filepath.Join(db.path, syncedName)); err != nil {
 		return err
 	}
@@ -215,6 +468,8 @@ func (db *FlatDatabase) Commit() error {
 	}
 	db.read = true
 	db.offset = 0
+	db.physOff = 0
+	db.chunk = 0
 
 	// Reopen the files in read-only mode
 	var err error
@@ -226,6 +481,14 @@ func (db *FlatDatabase) Commit() error {
 	if err != nil {
 		return err
 	}
+	if db.version == V2 {
+		if _, err := db.data.Seek(flatHeaderSize, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := db.index.Seek(flatHeaderSize, io.SeekStart); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -261,63 +524,84 @@ func (db *FlatDatabase) NewBatch() *FlatBatch {
 	return &FlatBatch{db: db}
 }
 
-type FlatBatch struct {
-	db      *FlatDatabase
-	keys    [][]byte
-	vals    [][]byte
-	keysize int
-	valsize int
-	lock    sync.RWMutex
-}
-
-// Put inserts the given value into the key-value data store.
-func (fb *FlatBatch) Put(key []byte, value []byte) error {
-	fb.lock.Lock()
-	defer fb.lock.Unlock()
-
-	fb.keys = append(fb.keys, key)
-	fb.vals = append(fb.vals, value)
-	fb.keysize += len(key)
-	fb.valsize += len(value)
-	return nil
-}
-
-// Delete removes the key from the key-value data store.
-func (fb *FlatBatch) Delete(key []byte) error { panic("not supported") }
-
-// ValueSize retrieves the amount of data queued up for writing.
-func (fb *FlatBatch) ValueSize() int {
-	fb.lock.RLock()
-	defer fb.lock.RUnlock()
-
-	return fb.valsize
-}
-
-// Write flushes any accumulated data to disk.
-func (fb *FlatBatch) Write() error {
-	fb.lock.Lock()
-	defer fb.lock.Unlock()
+// Snapshot flushes any buffered entries and returns a FlatSnapshot pinned to
+// the chunks committed to disk at this instant. Unlike NewIterator, it works
+// before Commit and doesn't block further writes: the snapshot reads through
+// its own file descriptors and its own bound on flat.index, so Put calls
+// issued after Snapshot returns are invisible to it.
+func (db *FlatDatabase) Snapshot() (*FlatSnapshot, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 
-	for i := 0; i < len(fb.keys); i++ {
-		if err := fb.db.Put(fb.keys[i], fb.vals[i]); err != nil {
-			return err
+	if !db.read {
+		if err := db.writeChunk(true); err != nil {
+			return nil, err
+		}
+		if err := db.data.Sync(); err != nil {
+			return nil, err
+		}
+		if err := db.index.Sync(); err != nil {
+			return nil, err
 		}
 	}
-	return nil
-}
-
-// Reset resets the batch for reuse.
-func (fb *FlatBatch) Reset() {
-	fb.lock.Lock()
-	defer fb.lock.Unlock()
-
-	fb.keysize, fb.valsize = 0, 0
-	fb.keys = fb.keys[:0]
-	fb.vals = fb.vals[:0]
+	dataFile := syncedName
+	if !db.read {
+		dataFile = temporaryName
+	}
+	indexStat, err := db.index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.OpenFile(filepath.Join(db.path, dataFile), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(db.path, indexName), os.O_RDONLY, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	var seekTo int64
+	if db.version == V2 {
+		seekTo = flatHeaderSize
+	}
+	if _, err := data.Seek(seekTo, io.SeekStart); err != nil {
+		data.Close()
+		index.Close()
+		return nil, err
+	}
+	if _, err := index.Seek(seekTo, io.SeekStart); err != nil {
+		data.Close()
+		index.Close()
+		return nil, err
+	}
+	return &FlatSnapshot{
+		reader: &FlatDatabase{
+			path:     db.path,
+			data:     data,
+			index:    index,
+			read:     true,
+			version:  db.version,
+			indexEnd: indexStat.Size(),
+		},
+	}, nil
 }
 
-// NewIterator creates a iterator over the **whole** database with first-in-first-out
-// order. The passed `prefix` and `start` is useless, just only to follow the interface.
+// NewIterator creates an iterator over the database in first-in-first-out
+// order. If prefix and start are both nil, it scans the whole database from
+// the beginning, as always.
+//
+// If either is set and the db was committed with Options.BuildSortedIndex,
+// the iterator uses flat.sindex to seek directly to the chunk that could
+// hold the larger of prefix and start, skips entries until it reaches that
+// boundary, and stops as soon as a key no longer carries prefix. This relies
+// on entries having been written in ascending key order, which flat.sindex's
+// presence guarantees was requested.
+//
+// Without a sparse index, prefix and start are ignored and the iterator
+// scans the whole database, as it always did before they existed: applying
+// them against data that isn't known to be sorted would silently drop
+// entries instead of merely failing to skip ahead.
 //
 // If there already exists a un-released iterator, the nil will be returned since
 // iteration concurrently is not supported by flatdb.
@@ -329,56 +613,105 @@ func (db *FlatDatabase) NewIterator(prefix []byte, start []byte) *FlatIterator {
 		return nil
 	}
 	db.iterating = true
-	db.data.Seek(0, 0)
-	db.index.Seek(0, 0)
 	db.offset = 0
+	db.physOff = 0
+	db.chunk = 0
 	db.buff = db.buff[:0]
-	return &FlatIterator{db: db}
+
+	boundary := maxBoundary(prefix, start)
+	sorted := boundary != nil && db.seekToBoundary(boundary)
+	if !sorted {
+		var seekTo int64
+		if db.version == V2 {
+			seekTo = flatHeaderSize
+		}
+		db.data.Seek(seekTo, io.SeekStart)
+		db.index.Seek(seekTo, io.SeekStart)
+		return &FlatIterator{db: db}
+	}
+	return &FlatIterator{db: db, prefix: prefix, boundary: boundary}
+}
+
+// maxBoundary returns whichever of prefix and start sorts later, or nil if
+// both are nil.
+func maxBoundary(prefix, start []byte) []byte {
+	switch {
+	case prefix == nil:
+		return start
+	case start == nil:
+		return prefix
+	case bytes.Compare(prefix, start) >= 0:
+		return prefix
+	default:
+		return start
+	}
 }
 
-// FlatIterator is the iterator used to itearate the whole db.
+// FlatIterator is the iterator used to itearate the whole db, or the
+// prefix/start-bounded slice of it requested from NewIterator.
 type FlatIterator struct {
-	db  *FlatDatabase
-	key []byte
-	val []byte
-	err error
-	eof bool
+	db       *FlatDatabase
+	key      []byte
+	val      []byte
+	err      error
+	eof      bool
+	prefix   []byte
+	boundary []byte // entries sorting before it are skipped until reached is set
+	reached  bool
+
+	// snapshot is set when this iterator was obtained from FlatSnapshot.NewIterator
+	// rather than FlatDatabase.NewIterator, so Release clears the right flag.
+	snapshot *FlatSnapshot
 }
 
 // Next moves the iterator to the next key/value pair. It returns whether the
 // iterator is exhausted.
 func (iter *FlatIterator) Next() bool {
-	if len(iter.db.buff) == 0 && !iter.eof {
-		if err := iter.db.readChunk(); err != nil {
-			if err == io.EOF {
-				iter.eof = true
-				return false
-			} else {
+	for {
+		if len(iter.db.buff) == 0 && !iter.eof {
+			if err := iter.db.readChunk(); err != nil {
+				if err == io.EOF {
+					iter.eof = true
+					return false
+				}
 				iter.err = err
 				return false
 			}
 		}
+		if len(iter.db.buff) == 0 {
+			return false
+		}
+		var offset int
+		x, n := binary.Uvarint(iter.db.buff)
+		offset += n
+		if n <= 0 {
+			return false
+		}
+		key := iter.db.buff[offset : offset+int(x)]
+		offset += int(x)
+		x, n = binary.Uvarint(iter.db.buff[offset:])
+		offset += n
+		if n <= 0 {
+			return false
+		}
+		val := iter.db.buff[offset : offset+int(x)]
+		offset += int(x)
+		iter.db.buff = iter.db.buff[offset:]
+
+		if !iter.reached {
+			if iter.boundary != nil && bytes.Compare(key, iter.boundary) < 0 {
+				continue
+			}
+			iter.reached = true
+		}
+		if len(iter.prefix) > 0 && !bytes.HasPrefix(key, iter.prefix) {
+			iter.eof = true
+			return false
+		}
+		iter.key = key
+		iter.val = val
+		return true
 	}
-	var offset int
-	x, n := binary.Uvarint(iter.db.buff)
-	offset += n
-	if n <= 0 {
-		return false
-	}
-	key := iter.db.buff[offset : offset+int(x)]
-	offset += int(x)
-	x, n = binary.Uvarint(iter.db.buff[offset:])
-	offset += n
-	if n <= 0 {
-		return false
-	}
-	val := iter.db.buff[offset : offset+int(x)]
-	offset += int(x)
-
-	iter.key = key
-	iter.val = val
-	iter.db.buff = iter.db.buff[offset:]
-	return true
 }
 
 // Error returns any accumulated error. Exhausting all the key/value pairs
@@ -404,5 +737,11 @@ func (iter *FlatIterator) Value() []byte {
 // Release releases associated resources. Release should always succeed and can
 // be called multiple times without causing error.
 func (iter *FlatIterator) Release() {
+	if iter.snapshot != nil {
+		iter.snapshot.lock.Lock()
+		iter.snapshot.iterating = false
+		iter.snapshot.lock.Unlock()
+		return
+	}
 	iter.db.iterating = false
 }
@@ -9,8 +9,11 @@ package flatdb
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -32,6 +35,18 @@ func newFlatDBTester(read bool) *flatDBTester {
 	}
 }
 
+func newFlatDBTesterWithOptions(read bool, opts *Options) *flatDBTester {
+	dir, _ := ioutil.TempDir("", "")
+	db, err := NewFlatDatabaseWithOptions(dir, read, opts)
+	if err != nil {
+		return nil
+	}
+	return &flatDBTester{
+		dir: dir,
+		db:  db,
+	}
+}
+
 func (tester *flatDBTester) teardown() {
 	if tester.dir != "" {
 		os.RemoveAll(tester.dir)
@@ -162,6 +177,226 @@ func TestFlatDatabase(t *testing.T) {
 	tester.checkIteration(t, keys, vals) // Check twice
 }
 
+func TestFlatDatabaseSnappyCompression(t *testing.T) {
+	tester := newFlatDBTesterWithOptions(false, &Options{Compression: CompressionSnappy})
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys, vals := newTestCases(1024 * 1024)
+	for i := 0; i < len(keys); i++ {
+		tester.Put(keys[i], vals[i])
+	}
+	tester.Commit()
+	tester.checkIteration(t, keys, vals)
+}
+
+func TestFlatDatabaseCorruptedChunk(t *testing.T) {
+	tester := newFlatDBTester(false)
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys, vals := newTestCases(16)
+	for i := 0; i < len(keys); i++ {
+		tester.Put(keys[i], vals[i])
+	}
+	tester.Commit()
+
+	// Flip a byte inside the (only) chunk's payload, past the file header
+	// and the chunk's own length header.
+	corruptByte(t, filepath.Join(tester.dir, syncedName), flatHeaderSize+chunkHeaderSize+1)
+
+	iter := tester.Iterate()
+	if iter == nil {
+		t.Fatalf("Failed to obtain iterator")
+	}
+	for iter.Next() {
+	}
+	corrupted, ok := iter.Error().(*ErrCorrupted)
+	if !ok {
+		t.Fatalf("Expect *ErrCorrupted, got %v", iter.Error())
+	}
+	if corrupted.ChunkIndex != 0 {
+		t.Fatalf("Expect corruption reported for chunk 0, got %d", corrupted.ChunkIndex)
+	}
+	iter.Release()
+}
+
+func TestRecover(t *testing.T) {
+	tester := newFlatDBTester(false)
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys, vals := newTestCases(150000)
+	for i := 0; i < len(keys); i++ {
+		tester.Put(keys[i], vals[i])
+	}
+	tester.Commit()
+
+	// Locate the chunk boundaries so a single payload byte can be flipped
+	// inside the second chunk specifically.
+	raw, err := ioutil.ReadFile(filepath.Join(tester.dir, indexName))
+	if err != nil {
+		t.Fatalf("Failed to read flat.index, error: %v", err)
+	}
+	entries := (len(raw) - flatHeaderSize) / indexEntrySize
+	if entries < 2 {
+		t.Fatalf("Expect at least 2 chunks for this test, got %d", entries)
+	}
+	entry0 := raw[flatHeaderSize : flatHeaderSize+indexEntrySize]
+	physEnd0 := binary.BigEndian.Uint64(entry0[8:16])
+	corruptByte(t, filepath.Join(tester.dir, syncedName), flatHeaderSize+int64(physEnd0)+chunkHeaderSize+1)
+
+	goodChunks, badChunks, err := Recover(tester.dir)
+	if err != nil {
+		t.Fatalf("Recover failed, error: %v", err)
+	}
+	if badChunks != 1 {
+		t.Fatalf("Expect exactly one corrupted chunk, got %d", badChunks)
+	}
+	if goodChunks != entries-1 {
+		t.Fatalf("Expect %d intact chunks, got %d", entries-1, goodChunks)
+	}
+
+	db, err := NewFlatDatabase(tester.dir, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen recovered db, error: %v", err)
+	}
+	tester.db = db
+
+	iter := tester.Iterate()
+	var got int
+	for iter.Next() {
+		got += 1
+	}
+	if iter.Error() != nil {
+		t.Fatalf("Unexpected error iterating recovered db, error: %v", iter.Error())
+	}
+	iter.Release()
+	if got == 0 || got >= len(keys) {
+		t.Fatalf("Expect recovered db to be missing exactly the corrupted chunk's entries, got %d out of %d", got, len(keys))
+	}
+}
+
+func TestFlatDatabaseV1Format(t *testing.T) {
+	tester := newFlatDBTesterWithOptions(false, &Options{FileFormat: V1})
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys, vals := newTestCases(1024 * 1024)
+	for i := 0; i < len(keys); i++ {
+		tester.Put(keys[i], vals[i])
+	}
+	tester.Commit()
+	if tester.db.version != V1 {
+		t.Fatalf("Expect db to stay in format V1, got %d", tester.db.version)
+	}
+	tester.checkIteration(t, keys, vals)
+}
+
+func TestConvert(t *testing.T) {
+	tester := newFlatDBTesterWithOptions(false, &Options{FileFormat: V1})
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys, vals := newTestCases(1024 * 1024)
+	for i := 0; i < len(keys); i++ {
+		tester.Put(keys[i], vals[i])
+	}
+	tester.Commit()
+
+	if err := Convert(tester.dir, V2); err != nil {
+		t.Fatalf("Failed to convert db, error: %v", err)
+	}
+	db, err := NewFlatDatabase(tester.dir, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen converted db, error: %v", err)
+	}
+	if db.version != V2 {
+		t.Fatalf("Expect db to be converted to format V2, got %d", db.version)
+	}
+	tester.db = db
+	tester.checkIteration(t, keys, vals)
+}
+
+func newSortedTestCases(size int) [][]byte {
+	var keys [][]byte
+	for i := 0; i < size; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key-%08d", i)))
+	}
+	return keys
+}
+
+func TestFlatDatabaseSortedIndexSeek(t *testing.T) {
+	tester := newFlatDBTesterWithOptions(false, &Options{BuildSortedIndex: true})
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	keys := newSortedTestCases(200000)
+	for _, key := range keys {
+		tester.Put(key, key)
+	}
+	tester.Commit()
+
+	// Without prefix/start, iteration still returns every entry in write order.
+	tester.checkIteration(t, keys, keys)
+
+	start := keys[len(keys)/2]
+	iter := tester.db.NewIterator(nil, start)
+	defer iter.Release()
+	if !iter.Next() {
+		t.Fatalf("Expect at least one entry from the start boundary")
+	}
+	if !bytes.Equal(iter.Key(), start) {
+		t.Fatalf("Expect iteration to begin at %s, got %s", start, iter.Key())
+	}
+}
+
+func TestFlatDatabaseIteratorIgnoresPrefixWithoutSortedIndex(t *testing.T) {
+	tester := newFlatDBTester(false)
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	// Deliberately out of key order, and never committed with
+	// Options.BuildSortedIndex: prefix/start must be ignored rather than
+	// applied against data that isn't known to be sorted.
+	keys := [][]byte{[]byte("zzz-first"), []byte("abc-match1"), []byte("abc-match2")}
+	for _, key := range keys {
+		tester.Put(key, key)
+	}
+	tester.Commit()
+
+	iter := tester.db.NewIterator([]byte("abc-"), nil)
+	if iter == nil {
+		t.Fatalf("Failed to obtain iterator")
+	}
+	defer iter.Release()
+
+	var got int
+	for iter.Next() {
+		got += 1
+	}
+	if iter.Error() != nil {
+		t.Fatalf("Unexpected iteration error %v", iter.Error())
+	}
+	if got != len(keys) {
+		t.Fatalf("Expect prefix to be ignored without a sorted index, want %d entries, got %d", len(keys), got)
+	}
+}
+
 func TestFlatDatabaseBatchWrite(t *testing.T) {
 	tester := newFlatDBTester(false)
 	if tester == nil {
@@ -224,6 +459,69 @@ func TestFlatDatabaseConcurrentWrite(t *testing.T) {
 	tester.checkIterationNoOrder(t, mix)
 }
 
+func TestFlatDatabaseSnapshot(t *testing.T) {
+	tester := newFlatDBTester(false)
+	if tester == nil {
+		t.Fatalf("Failed to init tester")
+	}
+	defer tester.teardown()
+
+	before, _ := newTestCases(1024)
+	for i := 0; i < len(before); i++ {
+		tester.Put(before[i], before[i])
+	}
+	snap, err := tester.db.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to take snapshot, error: %v", err)
+	}
+	defer snap.Release()
+
+	// Entries written after the snapshot was taken must not be visible
+	// through it, even though the live db is still accepting writes.
+	after, _ := newTestCases(1024)
+	for i := 0; i < len(after); i++ {
+		tester.Put(after[i], after[i])
+	}
+
+	iter := snap.NewIterator(nil, nil)
+	if iter == nil {
+		t.Fatalf("Failed to obtain snapshot iterator")
+	}
+	var got int
+	for iter.Next() {
+		got += 1
+	}
+	if iter.Error() != nil {
+		t.Fatalf("Snapshot iteration error %v", iter.Error())
+	}
+	iter.Release()
+	if got != len(before) {
+		t.Fatalf("Snapshot leaked post-snapshot writes, want %d, got %d", len(before), got)
+	}
+
+	// The live db keeps working and commits all entries, snapshot or not.
+	tester.Commit()
+	tester.checkIteration(t, append(before, after...), append(before, after...))
+}
+
+// corruptByte flips every bit of the byte at offset in the file at path.
+func corruptByte(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %s for corruption, error: %v", path, err)
+	}
+	defer f.Close()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		t.Fatalf("Failed to read byte to corrupt, error: %v", err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		t.Fatalf("Failed to write corrupted byte, error: %v", err)
+	}
+}
+
 // CopyBytes returns an exact copy of the provided bytes.
 func CopyBytes(b []byte) (copiedBytes []byte) {
 	if b == nil {
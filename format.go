@@ -0,0 +1,90 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Version identifies the on-disk layout of flat.db/flat.index.
+type Version uint16
+
+const (
+	// V1 is the original headerless layout: flat.db holds the raw,
+	// uncompressed entry stream and flat.index holds one 8-byte logical
+	// offset per chunk.
+	V1 Version = 1
+	// V2 prefixes both files with a flatHeader and frames each chunk with
+	// a length header and a CRC32C trailer (see writeChunkV2), optionally
+	// snappy-compressed, with a 17-byte flat.index entry per chunk.
+	V2 Version = 2
+)
+
+const flatHeaderSize = 16
+
+// flatMagic is the fixed 8-byte tag at the start of a V2 flat.db/flat.index
+// file. It's chosen so it can never be mistaken for a V1 file: V1's first
+// 8 bytes are either a logical offset (flat.index) or a key-length varint
+// followed by key bytes (flat.db), and "FLATDB\x00\x00" doesn't arise
+// naturally from either.
+var flatMagic = [8]byte{'F', 'L', 'A', 'T', 'D', 'B', 0, 0}
+
+// flatHeader is the fixed-size preamble written at the start of both files
+// of a V2 database.
+//
+//   +--------------+---------+-------+----------+
+//   | Magic (8)    | Version | Flags | Reserved |
+//   +--------------+---------+-------+----------+
+type flatHeader struct {
+	version Version
+	flags   uint16
+}
+
+func writeFlatHeader(f *os.File, h flatHeader) error {
+	var buf [flatHeaderSize]byte
+	copy(buf[:8], flatMagic[:])
+	binary.BigEndian.PutUint16(buf[8:10], uint16(h.version))
+	binary.BigEndian.PutUint16(buf[10:12], h.flags)
+	n, err := f.Write(buf[:])
+	if err != nil {
+		return err
+	}
+	if n != flatHeaderSize {
+		return ErrWriteFailure
+	}
+	return nil
+}
+
+// readFlatHeader inspects the start of f. If it carries a valid flatMagic,
+// the parsed header is returned and the file is left positioned right after
+// it. Otherwise f is assumed to be a legacy V1 file, the read bytes are
+// rewound, and a V1 header is returned with the file positioned back at 0.
+func readFlatHeader(f *os.File) (flatHeader, error) {
+	var buf [flatHeaderSize]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return flatHeader{}, err
+	}
+	if n == flatHeaderSize && bytes.Equal(buf[:8], flatMagic[:]) {
+		return flatHeader{
+			version: Version(binary.BigEndian.Uint16(buf[8:10])),
+			flags:   binary.BigEndian.Uint16(buf[10:12]),
+		}, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return flatHeader{}, err
+	}
+	return flatHeader{version: V1}, nil
+}
+
+func unsupportedVersionError(v Version) error {
+	return fmt.Errorf("flatdb: unsupported file format version %d", v)
+}
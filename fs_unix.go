@@ -0,0 +1,30 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build !windows
+
+package flatdb
+
+import "os"
+
+// rename atomically renames oldpath to newpath.
+func rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// syncDir flushes the directory entry of the given path to the disk, so
+// that a subsequent crash can't lose a just-renamed file.
+func syncDir(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build windows
+
+package flatdb
+
+import "os"
+
+// rename atomically renames oldpath to newpath.
+func rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// syncDir is a no-op on Windows since directory entries are not buffered
+// the way they are on POSIX filesystems.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+// CompressionType is the per-chunk compression codec. It's stored verbatim
+// in the flags byte of each flat.index entry, so new codecs can be added
+// without breaking databases written with an older one.
+type CompressionType uint8
+
+const (
+	// CompressionNone stores the chunk payload as-is.
+	CompressionNone CompressionType = iota
+	// CompressionSnappy snappy-encodes the chunk payload before it's
+	// written to disk, trading a bit of CPU for a smaller flat.db,
+	// mirroring leveldb's per-block snappy compression.
+	CompressionSnappy
+)
+
+// Options customizes the behavior of a FlatDatabase opened in write mode.
+type Options struct {
+	// Compression selects the codec applied to each chunk as it's flushed.
+	// It only affects chunks written through this handle; chunks already
+	// on disk keep whatever codec they were written with. Requires
+	// FileFormat V2.
+	Compression CompressionType
+
+	// FileFormat selects the on-disk layout new files are written in. The
+	// zero value defaults to V2; pass V1 to emit the legacy headerless
+	// layout for interop with older readers.
+	FileFormat Version
+
+	// BuildSortedIndex, when set, makes Commit additionally persist
+	// flat.sindex: a sorted index of each chunk's first key, letting
+	// NewIterator seek directly to the chunk a prefix/start boundary
+	// falls in instead of always scanning from the beginning. It only
+	// pays off when entries are written in ascending key order.
+	BuildSortedIndex bool
+}
+
+// format returns the effective file format, defaulting a zero value to V2.
+func (o *Options) format() Version {
+	if o.FileFormat == 0 {
+		return V2
+	}
+	return o.FileFormat
+}
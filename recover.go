@@ -0,0 +1,231 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+)
+
+const recoveredName = "recover.db"
+const recoveredIndexName = "recover.index"
+
+// Recover scans an already-committed flat database chunk by chunk, verifying
+// the CRC32C of each one, and rewrites flat.db/flat.index keeping only the
+// intact chunks. It returns the number of chunks that were intact and the
+// number that were dropped because they failed their checksum.
+//
+// Recover is only meaningful for a database that has already been Commit-ed;
+// it opens flat.db/flat.index directly rather than through a FlatDatabase,
+// but otherwise detects the file format the same way NewFlatDatabaseWithOptions
+// does, and dispatches accordingly. V1 chunks carry no checksum, so they are
+// always considered intact; badChunks is always 0 for a V1 database.
+func Recover(path string) (goodChunks, badChunks int, err error) {
+	data, err := os.OpenFile(filepath.Join(path, syncedName), os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer data.Close()
+
+	index, err := os.OpenFile(filepath.Join(path, indexName), os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer index.Close()
+
+	dataHeader, err := readFlatHeader(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	indexHeader, err := readFlatHeader(index)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dataHeader.version != indexHeader.version {
+		return 0, 0, fmt.Errorf("flatdb: flat.db is format V%d but flat.index is format V%d", dataHeader.version, indexHeader.version)
+	}
+	version := indexHeader.version
+	if version != V1 && version != V2 {
+		return 0, 0, unsupportedVersionError(version)
+	}
+
+	newData, err := os.OpenFile(filepath.Join(path, recoveredName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer newData.Close()
+
+	newIndex, err := os.OpenFile(filepath.Join(path, recoveredIndexName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer newIndex.Close()
+
+	if version == V2 {
+		if err := writeFlatHeader(newData, flatHeader{version: V2}); err != nil {
+			return 0, 0, err
+		}
+		if err := writeFlatHeader(newIndex, flatHeader{version: V2}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if version == V1 {
+		goodChunks, badChunks, err = recoverV1(data, index, newData, newIndex)
+	} else {
+		goodChunks, badChunks, err = recoverV2(data, index, newData, newIndex)
+	}
+	if err != nil {
+		return goodChunks, badChunks, err
+	}
+	if err := newData.Sync(); err != nil {
+		return goodChunks, badChunks, err
+	}
+	if err := newIndex.Sync(); err != nil {
+		return goodChunks, badChunks, err
+	}
+	if err := rename(filepath.Join(path, recoveredName), filepath.Join(path, syncedName)); err != nil {
+		return goodChunks, badChunks, err
+	}
+	if err := rename(filepath.Join(path, recoveredIndexName), filepath.Join(path, indexName)); err != nil {
+		return goodChunks, badChunks, err
+	}
+	return goodChunks, badChunks, syncDir(path)
+}
+
+// recoverV1 copies every chunk of a V1 database across verbatim: there is no
+// per-chunk checksum to verify in this format, so every chunk is intact by
+// definition.
+func recoverV1(data, index, newData, newIndex *os.File) (goodChunks, badChunks int, err error) {
+	var logical, newLogical uint64
+	for {
+		var entry [8]byte
+		n, rerr := index.Read(entry[:])
+		if rerr != nil {
+			if rerr == io.EOF {
+				break
+			}
+			return goodChunks, badChunks, rerr
+		}
+		if n != 8 {
+			return goodChunks, badChunks, ErrReadFailure
+		}
+		nextLogical := binary.BigEndian.Uint64(entry[:])
+		size := nextLogical - logical
+		logical = nextLogical
+
+		payload := make([]byte, size)
+		if n, rerr = data.Read(payload); rerr != nil {
+			return goodChunks, badChunks, rerr
+		}
+		if uint64(n) != size {
+			return goodChunks, badChunks, ErrReadFailure
+		}
+		goodChunks++
+
+		if _, err := newData.Write(payload); err != nil {
+			return goodChunks, badChunks, err
+		}
+		newLogical += size
+
+		var out [8]byte
+		binary.BigEndian.PutUint64(out[:], newLogical)
+		if _, err := newIndex.Write(out[:]); err != nil {
+			return goodChunks, badChunks, err
+		}
+	}
+	return goodChunks, badChunks, nil
+}
+
+// recoverV2 verifies and copies every chunk of a V2 database, dropping any
+// chunk whose CRC32C trailer doesn't match its payload.
+func recoverV2(data, index, newData, newIndex *os.File) (goodChunks, badChunks int, err error) {
+	var (
+		logical, physical       uint64 // offsets already consumed from the source files
+		newLogical, newPhysical uint64 // offsets already written to the recovered files
+	)
+	for {
+		var entry [indexEntrySize]byte
+		n, rerr := index.Read(entry[:])
+		if rerr != nil {
+			if rerr == io.EOF {
+				break
+			}
+			return goodChunks, badChunks, rerr
+		}
+		if n != indexEntrySize {
+			return goodChunks, badChunks, ErrReadFailure
+		}
+		nextLogical := binary.BigEndian.Uint64(entry[:8])
+		nextPhysical := binary.BigEndian.Uint64(entry[8:16])
+		flag := CompressionType(entry[16])
+		chunkPayloadSize := nextLogical - logical
+
+		frame := make([]byte, nextPhysical-physical)
+		if n, rerr = data.Read(frame); rerr != nil {
+			return goodChunks, badChunks, rerr
+		}
+		if n != len(frame) {
+			return goodChunks, badChunks, ErrReadFailure
+		}
+		logical, physical = nextLogical, nextPhysical
+
+		if !chunkIntact(frame, flag, chunkPayloadSize) {
+			badChunks++
+			continue
+		}
+		goodChunks++
+
+		if _, err := newData.Write(frame); err != nil {
+			return goodChunks, badChunks, err
+		}
+		newLogical += chunkPayloadSize
+		newPhysical += uint64(len(frame))
+
+		var out [indexEntrySize]byte
+		binary.BigEndian.PutUint64(out[:8], newLogical)
+		binary.BigEndian.PutUint64(out[8:16], newPhysical)
+		out[16] = byte(flag)
+		if _, err := newIndex.Write(out[:]); err != nil {
+			return goodChunks, badChunks, err
+		}
+	}
+	return goodChunks, badChunks, nil
+}
+
+// chunkIntact reports whether a raw chunk frame has a well-formed length
+// header, a valid CRC32C trailer, and decodes (per flag) to exactly wantSize
+// logical bytes.
+func chunkIntact(frame []byte, flag CompressionType, wantSize uint64) bool {
+	if len(frame) < chunkFrameSize {
+		return false
+	}
+	declared := binary.BigEndian.Uint32(frame[:chunkHeaderSize])
+	payload := frame[chunkHeaderSize : len(frame)-chunkTrailerSize]
+	if uint64(declared) != uint64(len(payload)) {
+		return false
+	}
+	trailer := binary.BigEndian.Uint32(frame[len(frame)-chunkTrailerSize:])
+	if crc32.Checksum(payload, crc32cTable) != trailer {
+		return false
+	}
+	switch flag {
+	case CompressionNone:
+		return uint64(len(payload)) == wantSize
+	case CompressionSnappy:
+		decoded, err := snappy.Decode(nil, payload)
+		return err == nil && uint64(len(decoded)) == wantSize
+	default:
+		return false
+	}
+}
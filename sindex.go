@@ -0,0 +1,197 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const sparseIndexName = "flat.sindex"
+
+// sparseEntry records the first key written to a chunk, keyed by its chunk
+// index, so NewIterator can binary-search its way to the chunk a prefix or
+// start boundary falls in.
+type sparseEntry struct {
+	key   []byte
+	chunk uint32
+}
+
+// buildSparseIndex scans the just-flushed (but not yet renamed) tmp.db/
+// flat.index of a write session, collects the first key of every chunk,
+// sorts the result by key and persists it as flat.sindex. It assumes the
+// caller wrote keys in ascending order; if they didn't, the sparse index is
+// still produced but NewIterator's seek optimization won't reliably cover
+// the intended range.
+func buildSparseIndex(path string, version Version) error {
+	data, err := os.OpenFile(filepath.Join(path, temporaryName), os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	index, err := os.OpenFile(filepath.Join(path, indexName), os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	if version == V2 {
+		if _, err := data.Seek(flatHeaderSize, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := index.Seek(flatHeaderSize, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	reader := &FlatDatabase{data: data, index: index, read: true, version: version}
+
+	var entries []sparseEntry
+	for chunk := uint32(0); ; chunk++ {
+		if err := reader.readChunk(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		key, ok := firstKey(reader.buff)
+		if !ok {
+			continue
+		}
+		entries = append(entries, sparseEntry{key: append([]byte(nil), key...), chunk: chunk})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+
+	return writeSparseIndex(path, entries)
+}
+
+// firstKey extracts the key of the first entry in a chunk payload, without
+// disturbing the buffer.
+func firstKey(payload []byte) ([]byte, bool) {
+	klen, n := binary.Uvarint(payload)
+	if n <= 0 || n+int(klen) > len(payload) {
+		return nil, false
+	}
+	return payload[n : n+int(klen)], true
+}
+
+func writeSparseIndex(path string, entries []sparseEntry) error {
+	f, err := os.OpenFile(filepath.Join(path, sparseIndexName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf []byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(e.key)))
+		buf = append(buf, lenBuf[:n]...)
+		buf = append(buf, e.key...)
+		var chunkBuf [4]byte
+		binary.BigEndian.PutUint32(chunkBuf[:], e.chunk)
+		buf = append(buf, chunkBuf[:]...)
+	}
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// loadSparseIndex reads flat.sindex, if present. A missing file is not an
+// error: it simply means the db wasn't committed with BuildSortedIndex.
+func loadSparseIndex(path string) ([]sparseEntry, error) {
+	raw, err := os.ReadFile(filepath.Join(path, sparseIndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []sparseEntry
+	for len(raw) > 0 {
+		klen, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, ErrReadFailure
+		}
+		raw = raw[n:]
+		if len(raw) < int(klen)+4 {
+			return nil, ErrReadFailure
+		}
+		entries = append(entries, sparseEntry{
+			key:   raw[:klen],
+			chunk: binary.BigEndian.Uint32(raw[klen : klen+4]),
+		})
+		raw = raw[klen+4:]
+	}
+	return entries, nil
+}
+
+// seekToBoundary repositions db so the next readChunk call returns the
+// last chunk (in sorted first-key order) whose first key is <= boundary, or
+// chunk 0 if every first key sorts after boundary, using flat.sindex. It
+// returns false (leaving db untouched) if no sparse index is available,
+// in which case the caller should fall back to a full scan from the start.
+func (db *FlatDatabase) seekToBoundary(boundary []byte) bool {
+	entries, err := loadSparseIndex(db.path)
+	if err != nil || len(entries) == 0 {
+		return false
+	}
+	idx := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].key, boundary) > 0
+	})
+	if idx == 0 {
+		return db.seekChunk(0)
+	}
+	return db.seekChunk(entries[idx-1].chunk)
+}
+
+// seekChunk positions the data/index file descriptors and offset bookkeeping
+// so the next readChunk call reads the given chunk index.
+func (db *FlatDatabase) seekChunk(chunk uint32) bool {
+	headerOff := int64(0)
+	entrySize := 8
+	if db.version == V2 {
+		headerOff = flatHeaderSize
+		entrySize = indexEntrySize
+	}
+	if chunk == 0 {
+		db.offset, db.physOff, db.chunk = 0, 0, 0
+		if _, err := db.index.Seek(headerOff, io.SeekStart); err != nil {
+			return false
+		}
+		if _, err := db.data.Seek(headerOff, io.SeekStart); err != nil {
+			return false
+		}
+		return true
+	}
+	// The index entry for chunk-1 carries the cumulative offsets marking
+	// the start of `chunk`; reading it also leaves the index cursor
+	// exactly where readChunk expects it for `chunk` itself.
+	if _, err := db.index.Seek(headerOff+int64(chunk-1)*int64(entrySize), io.SeekStart); err != nil {
+		return false
+	}
+	var entry [indexEntrySize]byte
+	n, err := db.index.Read(entry[:entrySize])
+	if err != nil || n != entrySize {
+		return false
+	}
+	logical := binary.BigEndian.Uint64(entry[:8])
+	physical := logical
+	if db.version == V2 {
+		physical = binary.BigEndian.Uint64(entry[8:16])
+	}
+	if _, err := db.data.Seek(headerOff+int64(physical), io.SeekStart); err != nil {
+		return false
+	}
+	db.offset, db.physOff, db.chunk = logical, physical, int(chunk)
+	return true
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020, Gary Rong <garyrong0905@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package flatdb
+
+import (
+	"io"
+	"sync"
+)
+
+// FlatSnapshot is a point-in-time, read-only view over the chunks a
+// FlatDatabase had flushed when FlatSnapshot was obtained via
+// FlatDatabase.Snapshot. It holds its own file descriptors and its own bound
+// on flat.index, so it keeps returning the same data regardless of further
+// Put, Commit or even another Snapshot call on the live db, making it a
+// viable feeder for a consumer that tails the db while ingestion continues.
+type FlatSnapshot struct {
+	lock sync.Mutex
+
+	reader    *FlatDatabase // Dedicated read-only handle, bound to indexEnd
+	iterating bool          // Concurrent iteration over one snapshot is not supported
+	released  bool
+}
+
+// NewIterator creates an iterator over the snapshot, honoring prefix/start the
+// same way FlatDatabase.NewIterator does - including falling back to a full
+// scan that ignores both when the db wasn't committed with
+// Options.BuildSortedIndex. If there already exists an un-released iterator
+// for this snapshot, or the snapshot was already released, nil is returned.
+// Independent snapshots - and their iterators - are otherwise fully
+// concurrent with each other and with further writes to the live db.
+func (snap *FlatSnapshot) NewIterator(prefix []byte, start []byte) *FlatIterator {
+	snap.lock.Lock()
+	defer snap.lock.Unlock()
+
+	if snap.released || snap.iterating {
+		return nil
+	}
+	snap.iterating = true
+
+	db := snap.reader
+	db.offset = 0
+	db.physOff = 0
+	db.chunk = 0
+	db.buff = db.buff[:0]
+
+	boundary := maxBoundary(prefix, start)
+	sorted := boundary != nil && db.seekToBoundary(boundary)
+	if !sorted {
+		var seekTo int64
+		if db.version == V2 {
+			seekTo = flatHeaderSize
+		}
+		db.data.Seek(seekTo, io.SeekStart)
+		db.index.Seek(seekTo, io.SeekStart)
+		return &FlatIterator{db: db, snapshot: snap}
+	}
+	return &FlatIterator{db: db, prefix: prefix, boundary: boundary, snapshot: snap}
+}
+
+// Release closes the snapshot's file descriptors. Release should always
+// succeed and can be called multiple times without causing error.
+func (snap *FlatSnapshot) Release() {
+	snap.lock.Lock()
+	defer snap.lock.Unlock()
+
+	if snap.released {
+		return
+	}
+	snap.released = true
+	snap.reader.data.Close()
+	snap.reader.index.Close()
+}